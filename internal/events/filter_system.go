@@ -0,0 +1,335 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+)
+
+// subscriptionOverflowDrops counts dispatches dropped because a
+// subscriber's channel was full, for callers to surface as a metric
+var subscriptionOverflowDrops uint64
+
+// SubscriptionOverflowDrops returns the cumulative count of log/head
+// dispatches dropped because a subscriber's channel was full
+func SubscriptionOverflowDrops() uint64 {
+	return atomic.LoadUint64(&subscriptionOverflowDrops)
+}
+
+type subscriptionKind int
+
+const (
+	logsSubscription subscriptionKind = iota
+	newHeadsSubscription
+)
+
+// Subscription is a single in-process consumer of an EventSystem, following
+// the same shape as go-ethereum's eth/filters.Subscription
+type Subscription struct {
+	kind  subscriptionKind
+	crit  ethFilter
+	logs  chan<- []*logEntry
+	heads chan<- *ethbinding.Header
+	err   chan error
+	es    *EventSystem
+
+	addrIndex  map[ethbinding.Address]bool
+	topicIndex []map[ethbinding.Hash]bool
+}
+
+// Err returns the channel the EventSystem closes when this subscription is
+// torn down, mirroring rpc.ClientSubscription
+func (s *Subscription) Err() <-chan error {
+	return s.err
+}
+
+// Unsubscribe removes this subscription from its EventSystem. Safe to call
+// more than once
+func (s *Subscription) Unsubscribe() {
+	s.es.unsubscribe(s)
+}
+
+// buildIndex compiles the subscription's address/topic filter criteria into
+// hash sets once at registration time, so matching a log against it on the
+// hot path is O(1) lookups rather than O(addresses*topics) scans per log
+func (s *Subscription) buildIndex() {
+	if len(s.crit.Addresses) > 0 {
+		s.addrIndex = make(map[ethbinding.Address]bool, len(s.crit.Addresses))
+		for _, a := range s.crit.Addresses {
+			s.addrIndex[a] = true
+		}
+	}
+	if len(s.crit.Topics) > 0 {
+		s.topicIndex = make([]map[ethbinding.Hash]bool, len(s.crit.Topics))
+		for i, topicsAtPos := range s.crit.Topics {
+			if len(topicsAtPos) == 0 {
+				continue // "don't care" position
+			}
+			m := make(map[ethbinding.Hash]bool, len(topicsAtPos))
+			for _, t := range topicsAtPos {
+				m[t] = true
+			}
+			s.topicIndex[i] = m
+		}
+	}
+}
+
+// matches reports whether a log satisfies this subscription's filter. An
+// unset address index or topic position matches any value, though the log
+// must still carry a topic at every position the filter lists, mirroring
+// eth_newFilter/eth_getLogs semantics
+func (s *Subscription) matches(l *logEntry) bool {
+	if s.addrIndex != nil && !s.addrIndex[l.Address] {
+		return false
+	}
+	if len(s.topicIndex) > len(l.Topics) {
+		return false
+	}
+	for i, m := range s.topicIndex {
+		if m == nil {
+			continue
+		}
+		if i >= len(l.Topics) || !m[l.Topics[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// EventSystem owns a single upstream feed of new logs and headers -
+// populated by the push transport's eth_subscribe connection, or by the
+// poll transport's eth_getFilterChanges results - and multiplexes them out
+// to any number of in-process Subscriptions. This lets many overlapping
+// subscriptions against the same node share one upstream filter/subscribe
+// call instead of each opening its own, following the design of
+// go-ethereum's eth/filters.EventSystem
+type EventSystem struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]bool
+
+	logsCh    chan []*logEntry
+	headsCh   chan *ethbinding.Header
+	installCh chan *Subscription
+	remove    chan *Subscription
+	quit      chan struct{}
+}
+
+// NewEventSystem creates an EventSystem and starts its dispatch goroutine
+func NewEventSystem() *EventSystem {
+	es := &EventSystem{
+		subs:      make(map[*Subscription]bool),
+		logsCh:    make(chan []*logEntry, 128),
+		headsCh:   make(chan *ethbinding.Header, 128),
+		installCh: make(chan *Subscription),
+		remove:    make(chan *Subscription),
+		quit:      make(chan struct{}),
+	}
+	go es.eventLoop()
+	return es
+}
+
+// install registers sub with the dispatch goroutine, returning an error
+// instead of blocking forever if the EventSystem has already been closed
+func (es *EventSystem) install(sub *Subscription) error {
+	select {
+	case es.installCh <- sub:
+		return nil
+	case <-es.quit:
+		return fmt.Errorf("EventSystem is closed")
+	}
+}
+
+// SubscribeLogs registers a new in-process log subscription matching crit.
+// Every batch of upstream logs published via PublishLogs is matched against
+// crit and, when one or more entries match, sent to ch without blocking -
+// if ch is full the batch is dropped and counted in SubscriptionOverflowDrops
+func (es *EventSystem) SubscribeLogs(crit ethFilter, ch chan<- []*logEntry) (*Subscription, error) {
+	sub := &Subscription{
+		kind: logsSubscription,
+		crit: crit,
+		logs: ch,
+		err:  make(chan error),
+		es:   es,
+	}
+	sub.buildIndex()
+	if err := es.install(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SubscribeNewHeads registers a new in-process subscription that receives
+// every header published via PublishHeader, regardless of filter criteria
+func (es *EventSystem) SubscribeNewHeads(ch chan<- *ethbinding.Header) (*Subscription, error) {
+	sub := &Subscription{
+		kind:  newHeadsSubscription,
+		heads: ch,
+		err:   make(chan error),
+		es:    es,
+	}
+	if err := es.install(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// EventChannel is a live, in-process tap into an EventSystem's shared
+// upstream feed, matched against filter. It's the consumer-facing handle
+// returned by Tap - callers read delivered batches off Logs() until Done()
+// closes, then call Close() to unsubscribe
+type EventChannel struct {
+	sub *Subscription
+	ch  chan []*logEntry
+}
+
+// Logs returns the channel matched log batches are delivered on
+func (c *EventChannel) Logs() <-chan []*logEntry {
+	return c.ch
+}
+
+// Done returns the channel the EventSystem closes when this tap is torn down
+func (c *EventChannel) Done() <-chan error {
+	return c.sub.Err()
+}
+
+// Close unsubscribes the tap from its EventSystem. Safe to call more than once
+func (c *EventChannel) Close() {
+	c.sub.Unsubscribe()
+}
+
+// Tap registers a live consumer matching filter against es's shared upstream
+// feed, so a caller that just wants delivery - rather than a full
+// SubscriptionInfo/logProcessor of its own - can read matched log batches
+// directly off the returned EventChannel as they're published. This is how
+// API surfaces other than the stream-polling runtime (e.g. the FFCAPI
+// connector's event-listener status draining) consume SubscribeLogs without
+// opening another upstream filter
+func (es *EventSystem) Tap(filter persistedFilter) (*EventChannel, error) {
+	ch := make(chan []*logEntry, 16)
+	sub, err := es.SubscribeLogs(ethFilter{persistedFilter: filter}, ch)
+	if err != nil {
+		return nil, err
+	}
+	return &EventChannel{sub: sub, ch: ch}, nil
+}
+
+func (es *EventSystem) unsubscribe(sub *Subscription) {
+	select {
+	case es.remove <- sub:
+	case <-es.quit:
+	}
+}
+
+// PublishLogs feeds a batch of logs from the upstream transport into the
+// dispatcher, to be matched against every active log subscription
+func (es *EventSystem) PublishLogs(logs []*logEntry) {
+	if len(logs) == 0 {
+		return
+	}
+	select {
+	case es.logsCh <- logs:
+	case <-es.quit:
+	}
+}
+
+// PublishHeader feeds a new block header from the upstream transport into
+// the dispatcher, to be delivered to every active new-heads subscription
+func (es *EventSystem) PublishHeader(h *ethbinding.Header) {
+	select {
+	case es.headsCh <- h:
+	case <-es.quit:
+	}
+}
+
+// Close stops the dispatch goroutine and tears down every active subscription
+func (es *EventSystem) Close() {
+	close(es.quit)
+}
+
+func (es *EventSystem) eventLoop() {
+	for {
+		select {
+		case sub := <-es.installCh:
+			es.mu.Lock()
+			es.subs[sub] = true
+			es.mu.Unlock()
+
+		case sub := <-es.remove:
+			es.mu.Lock()
+			if es.subs[sub] {
+				delete(es.subs, sub)
+				close(sub.err)
+			}
+			es.mu.Unlock()
+
+		case logs := <-es.logsCh:
+			es.mu.RLock()
+			for sub := range es.subs {
+				if sub.kind != logsSubscription {
+					continue
+				}
+				es.dispatchLogs(sub, logs)
+			}
+			es.mu.RUnlock()
+
+		case h := <-es.headsCh:
+			es.mu.RLock()
+			for sub := range es.subs {
+				if sub.kind != newHeadsSubscription {
+					continue
+				}
+				select {
+				case sub.heads <- h:
+				default:
+					atomic.AddUint64(&subscriptionOverflowDrops, 1)
+				}
+			}
+			es.mu.RUnlock()
+
+		case <-es.quit:
+			es.mu.Lock()
+			for sub := range es.subs {
+				close(sub.err)
+			}
+			es.subs = nil
+			es.mu.Unlock()
+			return
+		}
+	}
+}
+
+// dispatchLogs filters a batch of logs down to those matching sub's
+// criteria, and performs a non-blocking send of the remainder so one slow
+// consumer can never stall delivery to the rest
+func (es *EventSystem) dispatchLogs(sub *Subscription, logs []*logEntry) {
+	var matched []*logEntry
+	for _, l := range logs {
+		if sub.matches(l) {
+			matched = append(matched, l)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+	select {
+	case sub.logs <- matched:
+	default:
+		atomic.AddUint64(&subscriptionOverflowDrops, 1)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+)
+
+var (
+	addr1  = ethbinding.Address{0x01}
+	addr2  = ethbinding.Address{0x02}
+	topic1 = ethbinding.Hash{0x0a}
+	topic2 = ethbinding.Hash{0x0b}
+)
+
+func TestSubscriptionMatchesAddress(t *testing.T) {
+	sub := &Subscription{crit: ethFilter{persistedFilter: persistedFilter{
+		Addresses: []ethbinding.Address{addr1},
+	}}}
+	sub.buildIndex()
+
+	if !sub.matches(&logEntry{Address: addr1}) {
+		t.Error("expected log from addr1 to match")
+	}
+	if sub.matches(&logEntry{Address: addr2}) {
+		t.Error("expected log from addr2 not to match")
+	}
+}
+
+func TestSubscriptionMatchesTopics(t *testing.T) {
+	sub := &Subscription{crit: ethFilter{persistedFilter: persistedFilter{
+		Topics: [][]ethbinding.Hash{{topic1}, {}},
+	}}}
+	sub.buildIndex()
+
+	// position 0 must be topic1, position 1 is "don't care"
+	if !sub.matches(&logEntry{Topics: []ethbinding.Hash{topic1, topic2}}) {
+		t.Error("expected matching first topic to match")
+	}
+	if sub.matches(&logEntry{Topics: []ethbinding.Hash{topic2, topic1}}) {
+		t.Error("expected mismatched first topic not to match")
+	}
+	if sub.matches(&logEntry{Topics: []ethbinding.Hash{topic1}}) {
+		t.Error("expected a log missing a required topic position not to match")
+	}
+}
+
+func TestSubscriptionMatchesNoFilter(t *testing.T) {
+	sub := &Subscription{}
+	sub.buildIndex()
+
+	if !sub.matches(&logEntry{Address: addr1, Topics: []ethbinding.Hash{topic1}}) {
+		t.Error("expected a subscription with no criteria to match everything")
+	}
+}
+
+func TestEventSystemPublishLogsDeliversToMatchingSubscription(t *testing.T) {
+	es := NewEventSystem()
+	defer es.Close()
+
+	ch := make(chan []*logEntry, 1)
+	sub, err := es.SubscribeLogs(ethFilter{persistedFilter: persistedFilter{
+		Addresses: []ethbinding.Address{addr1},
+	}}, ch)
+	if err != nil {
+		t.Fatalf("unexpected error subscribing: %s", err)
+	}
+	defer sub.Unsubscribe()
+
+	es.PublishLogs([]*logEntry{{Address: addr2}, {Address: addr1}})
+
+	select {
+	case logs := <-ch:
+		if len(logs) != 1 || logs[0].Address != addr1 {
+			t.Errorf("expected exactly the addr1 log to be delivered, got %+v", logs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for matching log to be delivered")
+	}
+}
+
+func TestEventSystemDropsOnFullSubscriberChannel(t *testing.T) {
+	es := NewEventSystem()
+	defer es.Close()
+
+	before := SubscriptionOverflowDrops()
+
+	// unbuffered channel with nothing reading from it - every dispatch
+	// must fall into dispatchLogs' non-blocking default case
+	ch := make(chan []*logEntry)
+	sub, err := es.SubscribeLogs(ethFilter{}, ch)
+	if err != nil {
+		t.Fatalf("unexpected error subscribing: %s", err)
+	}
+	defer sub.Unsubscribe()
+
+	es.PublishLogs([]*logEntry{{Address: addr1}})
+
+	// give the dispatch goroutine a chance to process the publish and hit
+	// the full-channel default case before we check the counter
+	deadline := time.Now().Add(time.Second)
+	for SubscriptionOverflowDrops() == before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if SubscriptionOverflowDrops() <= before {
+		t.Error("expected a dispatch to a full subscriber channel to be counted as a drop")
+	}
+}
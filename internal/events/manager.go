@@ -0,0 +1,65 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"math/big"
+)
+
+// LogQuery is the set of criteria accepted by SubscriptionManager.QueryLogs,
+// mirroring the filter criteria accepted by eth_getLogs
+type LogQuery struct {
+	Filter    persistedFilter `json:"filter"`
+	FromBlock string          `json:"fromBlock,omitempty"`
+	ToBlock   string          `json:"toBlock,omitempty"`
+}
+
+// SubscriptionManager is the public façade other API surfaces - the
+// existing REST/WebSocket admin API, and the FFCAPI connector - use to
+// manage subscriptions and query their logs, independent of the
+// stream-polling runtime in this package
+type SubscriptionManager interface {
+	// CreateSubscription creates and starts a new subscription, returning
+	// the persisted SubscriptionInfo (with ID/Summary/Name populated)
+	CreateSubscription(ctx context.Context, info *SubscriptionInfo) (*SubscriptionInfo, error)
+	// DeleteSubscription unsubscribes and removes a subscription by ID
+	DeleteSubscription(ctx context.Context, id string) error
+	// SubscriptionByID returns the persisted info for a subscription
+	SubscriptionByID(id string) (*SubscriptionInfo, error)
+	// SubscriptionCheckpoint returns the block high-water-mark a
+	// subscription has processed up to
+	SubscriptionCheckpoint(id string) (*big.Int, error)
+	// ResetSubscription requests the subscription replay from its
+	// configured FromBlock on the next polling/connect cycle
+	ResetSubscription(ctx context.Context, id string) error
+	// QueryLogs performs a one-off eth_getLogs style query against the
+	// node, stamping each entry with its block timestamp from the shared
+	// block-timestamp cache where available
+	QueryLogs(ctx context.Context, q *LogQuery) ([]*logEntry, error)
+	// EventSystem returns the shared in-process pub/sub multiplexer that
+	// subscriptions attached to it (see subscription.attachEventSystem)
+	// publish their delivered logs/heads through, so other API surfaces
+	// (REST, WebSocket, FFCAPI) can add their own live consumers without
+	// opening another upstream filter
+	EventSystem() *EventSystem
+	// EnsureFFCAPIStream returns the ID of a stream suitable for delivering
+	// a listener created without a caller-registered webhook - a single
+	// instance is created on first use and reused for every such listener,
+	// so an FFCAPI caller can create an event listener up front and drain
+	// its deliveries later via GetEvents/GetEventListenerStatus, rather than
+	// having to provision a webhook stream of its own first
+	EnsureFFCAPIStream(ctx context.Context) (string, error)
+}
@@ -52,6 +52,7 @@ type SubscriptionInfo struct {
 	Filter    persistedFilter                  `json:"filter"`
 	Event     *ethbinding.ABIElementMarshaling `json:"event"`
 	FromBlock string                           `json:"fromBlock,omitempty"`
+	Transport string                           `json:"transport,omitempty"`
 }
 
 // subscription is the runtime that manages the subscription
@@ -65,6 +66,33 @@ type subscription struct {
 	filterStale    bool
 	deleting       bool
 	resetRequested bool
+	transport      subscriptionTransport
+	es             *EventSystem
+}
+
+// attachEventSystem wires this subscription's delivered logs/heads through a
+// shared EventSystem, so any in-process consumers (e.g. a live FFCAPI event
+// channel) can subscribe once rather than each opening their own upstream filter
+func (s *subscription) attachEventSystem(es *EventSystem) {
+	s.es = es
+}
+
+// eventSystemProvider is implemented by a subscriptionManager that also owns
+// a shared EventSystem (see SubscriptionManager.EventSystem) - every
+// subscription it creates or restores is attached to that instance, so
+// whichever API surface asks for it first doesn't have to open a second
+// upstream filter against the same node
+type eventSystemProvider interface {
+	EventSystem() *EventSystem
+}
+
+// attachSharedEventSystem attaches s to sm's shared EventSystem, if sm
+// provides one - shared by newSubscription and restoreSubscription, the two
+// places a subscription comes into existence
+func attachSharedEventSystem(s *subscription, sm subscriptionManager) {
+	if esp, ok := sm.(eventSystemProvider); ok {
+		s.attachEventSystem(esp.EventSystem())
+	}
 }
 
 func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding.Address, i *SubscriptionInfo) (*subscription, error) {
@@ -100,7 +128,12 @@ func newSubscription(sm subscriptionManager, rpc eth.RPCClient, addr *ethbinding
 	}
 	// For now we only support filtering on the event type
 	f.Topics = [][]ethbinding.Hash{{event.ID}}
-	log.Infof("Created subscription ID:%s name:%s topic:%s", i.ID, i.Name, event.ID)
+	if i.Transport == "" {
+		i.Transport = DefaultTransport
+	}
+	s.transport = newSubscriptionTransport(s)
+	attachSharedEventSystem(s, sm)
+	log.Infof("Created subscription ID:%s name:%s topic:%s transport:%s", i.ID, i.Name, event.ID, i.Transport)
 	return s, nil
 }
 
@@ -128,6 +161,11 @@ func restoreSubscription(sm subscriptionManager, rpc eth.RPCClient, i *Subscript
 		logName:     i.ID + ":" + ethbind.API.ABIEventSignature(event),
 		filterStale: true,
 	}
+	if i.Transport == "" {
+		i.Transport = DefaultTransport
+	}
+	s.transport = newSubscriptionTransport(s)
+	attachSharedEventSystem(s, sm)
 	return s, nil
 }
 
@@ -158,6 +196,15 @@ func (s *subscription) setCheckpointBlockHeight(i *big.Int) {
 }
 
 func (s *subscription) restartFilter(ctx context.Context, since *big.Int) error {
+	if _, isPush := s.transport.(*pushTransport); isPush {
+		s.lp.initBlockHWM(since)
+		if err := s.transport.start(ctx); err != nil {
+			return err
+		}
+		s.markFilterStale(ctx, false)
+		log.Infof("%s: started push subscription from block %s", s.logName, since.String())
+		return nil
+	}
 	f := &ethFilter{}
 	f.persistedFilter = s.info.Filter
 	f.FromBlock.ToInt().Set(since)
@@ -203,6 +250,11 @@ func (s *subscription) getEventTimestamp(ctx context.Context, l *logEntry) {
 }
 
 func (s *subscription) processNewEvents(ctx context.Context) error {
+	if _, isPush := s.transport.(*pushTransport); isPush {
+		// Push-mode subscriptions never set a filterID - delivery happens
+		// on the pushTransport's own goroutine, not on this polling tick
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 	var logs []*logEntry
@@ -228,6 +280,9 @@ func (s *subscription) processNewEvents(ctx context.Context) error {
 			log.Errorf("Failed to process event: %s", err)
 		}
 	}
+	if s.es != nil {
+		s.es.PublishLogs(logs)
+	}
 	s.filteredOnce = true
 	return nil
 }
@@ -236,6 +291,7 @@ func (s *subscription) unsubscribe(ctx context.Context, deleting bool) (err erro
 	log.Infof("%s: Unsubscribing existing filter (deleting=%t)", s.logName, deleting)
 	s.deleting = deleting
 	s.resetRequested = false
+	s.transport.stop()
 	s.markFilterStale(ctx, true)
 	return err
 }
@@ -253,8 +309,11 @@ func (s *subscription) blockHWM() big.Int {
 
 func (s *subscription) markFilterStale(ctx context.Context, newFilterStale bool) {
 	log.Debugf("%s: Marking filter stale=%t, current sub filter stale=%t", s.logName, newFilterStale, s.filterStale)
-	// If unsubscribe is called multiple times, we might not have a filter
-	if newFilterStale && !s.filterStale {
+	_, isPush := s.transport.(*pushTransport)
+	// If unsubscribe is called multiple times, we might not have a filter.
+	// Push-mode subscriptions never install an eth_newFilter filter either
+	// (see processNewEvents), so there is nothing to uninstall for them
+	if newFilterStale && !s.filterStale && !isPush {
 		var retval bool
 		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		defer cancel()
@@ -0,0 +1,288 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	"github.com/kaleido-io/ethconnect/internal/errors"
+	"github.com/kaleido-io/ethconnect/internal/eth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TransportPoll drives delivery by periodically re-querying an eth_newFilter filter
+	TransportPoll = "poll"
+	// TransportPush keeps a persistent eth_subscribe("logs") connection open and streams events as they occur
+	TransportPush = "push"
+	// DefaultTransport is used for subscriptions that do not request one explicitly
+	DefaultTransport = TransportPoll
+
+	pushReconnectDelay = 5 * time.Second
+)
+
+// clientSubscription mirrors go-ethereum's rpc.ClientSubscription - the
+// handle returned by a successful eth_subscribe call
+type clientSubscription interface {
+	Err() <-chan error
+	Unsubscribe()
+}
+
+// subscribingRPCClient is implemented by an eth.RPCClient that also supports
+// native eth_subscribe over a persistent WebSocket connection
+type subscribingRPCClient interface {
+	eth.RPCClient
+	Subscribe(ctx context.Context, channel interface{}, args ...interface{}) (clientSubscription, error)
+}
+
+// subscriptionTransport delivers chain events to a subscription's logProcessor.
+// "poll" is the original behavior - the stream goroutine calls processNewEvents
+// on a timer. "push" opens its own eth_subscribe connections and delivers
+// events as they arrive, reconnecting and replaying on disconnect
+type subscriptionTransport interface {
+	// start begins delivery. For "push" this opens the upstream subscriptions
+	// and starts a background goroutine; for "poll" it is a no-op, since
+	// delivery remains driven externally via subscription.processNewEvents
+	start(ctx context.Context) error
+	// stop tears down any background goroutine and upstream subscriptions
+	stop()
+}
+
+// newSubscriptionTransport selects the transport for a subscription based on
+// its configured SubscriptionInfo.Transport, falling back to "poll" when the
+// RPC client in use doesn't support native eth_subscribe
+func newSubscriptionTransport(s *subscription) subscriptionTransport {
+	if s.info.Transport == TransportPush {
+		if subRPC, ok := s.rpc.(subscribingRPCClient); ok {
+			return &pushTransport{s: s, rpc: subRPC}
+		}
+		log.Warnf("%s: push transport requested but RPC client does not support eth_subscribe - falling back to poll", s.logName)
+	}
+	return &pollTransport{}
+}
+
+type pollTransport struct{}
+
+func (t *pollTransport) start(ctx context.Context) error { return nil }
+func (t *pollTransport) stop()                           {}
+
+// pushTransport delivers logs over a persistent eth_subscribe("logs")
+// connection, and tracks eth_subscribe("newHeads") to advance the block HWM
+// when a period passes with no matching logs, and to publish new heads to an
+// attached EventSystem
+type pushTransport struct {
+	s       *subscription
+	rpc     subscribingRPCClient
+	logCh   chan json.RawMessage
+	headCh  chan json.RawMessage
+	logSub  clientSubscription
+	headSub clientSubscription
+	stopped chan struct{}
+	done    chan struct{}
+
+	mu      sync.Mutex
+	running bool
+}
+
+// start is idempotent - if the transport is already running (e.g. because
+// restartFilter is invoked again while filterStale is still true) it is a
+// no-op, rather than leaking a second upstream subscription and loop goroutine
+func (t *pushTransport) start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		return nil
+	}
+	t.logCh = make(chan json.RawMessage)
+	t.headCh = make(chan json.RawMessage)
+	t.stopped = make(chan struct{})
+	t.done = make(chan struct{})
+	if err := t.subscribeLogs(ctx); err != nil {
+		return err
+	}
+	if err := t.subscribeHeads(ctx); err != nil {
+		t.logSub.Unsubscribe()
+		return err
+	}
+	t.running = true
+	go t.loop(ctx, t.done)
+	return nil
+}
+
+func (t *pushTransport) subscribeLogs(ctx context.Context) error {
+	f := &ethFilter{}
+	f.persistedFilter = t.s.info.Filter
+	hwm := t.s.blockHWM()
+	f.FromBlock.ToInt().Set(&hwm)
+	f.ToBlock = "latest"
+	sub, err := t.rpc.Subscribe(ctx, t.logCh, "logs", f)
+	if err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_subscribe(logs)", err)
+	}
+	t.logSub = sub
+	log.Infof("%s: opened push (eth_subscribe) log delivery", t.s.logName)
+	return nil
+}
+
+func (t *pushTransport) subscribeHeads(ctx context.Context) error {
+	sub, err := t.rpc.Subscribe(ctx, t.headCh, "newHeads")
+	if err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_subscribe(newHeads)", err)
+	}
+	t.headSub = sub
+	return nil
+}
+
+// loop runs until stopped or ctx is cancelled, then closes done so a
+// concurrent stop() knows it is safe to unsubscribe and a subsequent start()
+// knows it is safe to replace t.logSub/t.headSub without racing this goroutine
+func (t *pushTransport) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case raw := <-t.logCh:
+			t.deliverLog(raw)
+		case raw := <-t.headCh:
+			t.advanceHWM(raw)
+		case err := <-t.logSub.Err():
+			t.reconnect(ctx, err)
+		case err := <-t.headSub.Err():
+			t.reconnect(ctx, err)
+		case <-t.stopped:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *pushTransport) deliverLog(raw json.RawMessage) {
+	var le logEntry
+	if err := json.Unmarshal(raw, &le); err != nil {
+		log.Errorf("%s: failed to unmarshal pushed log: %s", t.s.logName, err)
+		return
+	}
+	if t.s.lp.stream.spec.Timestamps {
+		t.s.getEventTimestamp(context.Background(), &le)
+	}
+	if err := t.s.lp.processLogEntry(t.s.logName, &le, 0); err != nil {
+		log.Errorf("%s: failed to process pushed event: %s", t.s.logName, err)
+	}
+	if t.s.es != nil {
+		t.s.es.PublishLogs([]*logEntry{&le})
+	}
+}
+
+func (t *pushTransport) advanceHWM(raw json.RawMessage) {
+	var hdr ethbinding.Header
+	if err := json.Unmarshal(raw, &hdr); err != nil {
+		log.Errorf("%s: failed to unmarshal pushed head: %s", t.s.logName, err)
+		return
+	}
+	t.s.lp.initBlockHWM(hdr.Number)
+	if t.s.es != nil {
+		t.s.es.PublishHeader(&hdr)
+	}
+}
+
+// reconnect is invoked when either the log or head subscription drops. It
+// replays any logs emitted since the last checkpointed block via
+// eth_getLogs to close the gap, then re-establishes both subscriptions
+func (t *pushTransport) reconnect(ctx context.Context, cause error) {
+	log.Warnf("%s: push subscription dropped, reconnecting: %s", t.s.logName, cause)
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if err := t.replay(ctx); err != nil {
+			log.Errorf("%s: replay after reconnect failed, retrying: %s", t.s.logName, err)
+			time.Sleep(pushReconnectDelay)
+			continue
+		}
+		if err := t.subscribeLogs(ctx); err != nil {
+			log.Errorf("%s: re-subscribe to logs failed, retrying: %s", t.s.logName, err)
+			time.Sleep(pushReconnectDelay)
+			continue
+		}
+		if err := t.subscribeHeads(ctx); err != nil {
+			log.Errorf("%s: re-subscribe to newHeads failed, retrying: %s", t.s.logName, err)
+			t.logSub.Unsubscribe()
+			time.Sleep(pushReconnectDelay)
+			continue
+		}
+		return
+	}
+}
+
+func (t *pushTransport) replay(ctx context.Context) error {
+	f := &ethFilter{}
+	f.persistedFilter = t.s.info.Filter
+	hwm := t.s.blockHWM()
+	f.FromBlock.ToInt().Set(&hwm)
+	f.ToBlock = "latest"
+	var logs []*logEntry
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := t.s.rpc.CallContext(ctx, &logs, "eth_getLogs", f); err != nil {
+		return errors.Errorf(errors.RPCCallReturnedError, "eth_getLogs", err)
+	}
+	if len(logs) > 0 {
+		log.Infof("%s: replaying %d events missed while push subscription was down", t.s.logName, len(logs))
+	}
+	for idx, le := range logs {
+		if t.s.lp.stream.spec.Timestamps {
+			t.s.getEventTimestamp(ctx, le)
+		}
+		if err := t.s.lp.processLogEntry(t.s.logName, le, idx); err != nil {
+			log.Errorf("%s: failed to process replayed event: %s", t.s.logName, err)
+		}
+	}
+	if t.s.es != nil {
+		t.s.es.PublishLogs(logs)
+	}
+	return nil
+}
+
+// stop is idempotent - calling it when the transport isn't running is a
+// no-op. It waits for loop to actually exit before unsubscribing and
+// returning, so a start() that follows immediately after never races loop's
+// use of t.logSub/t.headSub with its own
+func (t *pushTransport) stop() {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return
+	}
+	close(t.stopped)
+	done := t.done
+	t.running = false
+	t.mu.Unlock()
+
+	<-done
+	if t.logSub != nil {
+		t.logSub.Unsubscribe()
+	}
+	if t.headSub != nil {
+		t.headSub.Unsubscribe()
+	}
+}
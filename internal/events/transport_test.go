@@ -0,0 +1,79 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/eth"
+)
+
+// fakeRPCClient satisfies eth.RPCClient without native eth_subscribe support,
+// exercising the push-requested-but-unsupported fallback path
+type fakeRPCClient struct {
+	eth.RPCClient
+}
+
+// fakeSubscribingRPCClient additionally satisfies subscribingRPCClient
+type fakeSubscribingRPCClient struct {
+	eth.RPCClient
+}
+
+func (f *fakeSubscribingRPCClient) Subscribe(ctx context.Context, channel interface{}, args ...interface{}) (clientSubscription, error) {
+	return nil, nil
+}
+
+func TestNewSubscriptionTransportSelectsPushWhenSupported(t *testing.T) {
+	s := &subscription{
+		info: &SubscriptionInfo{Transport: TransportPush},
+		rpc:  &fakeSubscribingRPCClient{},
+	}
+	tr := newSubscriptionTransport(s)
+	if _, ok := tr.(*pushTransport); !ok {
+		t.Errorf("expected a push transport, got %T", tr)
+	}
+}
+
+func TestNewSubscriptionTransportFallsBackToPollWhenUnsupported(t *testing.T) {
+	s := &subscription{
+		info:    &SubscriptionInfo{Transport: TransportPush},
+		rpc:     &fakeRPCClient{},
+		logName: "test",
+	}
+	tr := newSubscriptionTransport(s)
+	if _, ok := tr.(*pollTransport); !ok {
+		t.Errorf("expected a fallback poll transport when the RPC client doesn't support eth_subscribe, got %T", tr)
+	}
+}
+
+func TestNewSubscriptionTransportSelectsPollWhenRequested(t *testing.T) {
+	s := &subscription{
+		info: &SubscriptionInfo{Transport: TransportPoll},
+		rpc:  &fakeSubscribingRPCClient{},
+	}
+	tr := newSubscriptionTransport(s)
+	if _, ok := tr.(*pollTransport); !ok {
+		t.Errorf("expected a poll transport when Transport=poll even though the RPC client supports push, got %T", tr)
+	}
+}
+
+func TestPollTransportStartStopAreNoOps(t *testing.T) {
+	tr := &pollTransport{}
+	if err := tr.start(context.Background()); err != nil {
+		t.Errorf("expected start to be a no-op, got %s", err)
+	}
+	tr.stop() // must not panic
+}
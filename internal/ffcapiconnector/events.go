@@ -0,0 +1,267 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffcapiconnector
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/hyperledger/firefly-common/pkg/ffcapi"
+	"github.com/hyperledger/firefly-ethconnect/internal/errors"
+	"github.com/hyperledger/firefly-ethconnect/internal/events"
+	ethbinding "github.com/kaleido-io/ethbinding/pkg"
+	log "github.com/sirupsen/logrus"
+)
+
+// createEventListenerRequest is the payload for ffcapi.RequestTypeCreateEventListener.
+// Stream optionally names an existing webhook stream (provisioned out of
+// band, e.g. via the REST event-streams API) to deliver batched log
+// deliveries to. When omitted, deliveries go to the shared FFCAPI channel
+// stream instead, and the caller drains them via GetEvents/GetEventListenerStatus
+type createEventListenerRequest struct {
+	ffcapi.RequestBase
+	ListenerID string                           `json:"listenerId"`
+	Event      *ethbinding.ABIElementMarshaling `json:"event"`
+	Address    *ethbinding.Address              `json:"address,omitempty"`
+	FromBlock  string                           `json:"fromBlock,omitempty"`
+	Stream     string                           `json:"stream,omitempty"`
+}
+
+type createEventListenerResponse struct {
+	ListenerID string `json:"listenerId"`
+}
+
+type deleteEventListenerRequest struct {
+	ffcapi.RequestBase
+	ListenerID string `json:"listenerId"`
+}
+
+type deleteEventListenerResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+type getEventListenerStatusRequest struct {
+	ffcapi.RequestBase
+	ListenerID string `json:"listenerId"`
+	Reset      bool   `json:"reset,omitempty"`
+}
+
+type getEventListenerStatusResponse struct {
+	ListenerID string                `json:"listenerId"`
+	Checkpoint string                `json:"checkpoint"`
+	Events     []*eventWithTimestamp `json:"events,omitempty"`
+}
+
+type getEventsRequest struct {
+	ffcapi.RequestBase
+	Address   *ethbinding.Address `json:"address,omitempty"`
+	Topics    [][]ethbinding.Hash `json:"topics,omitempty"`
+	FromBlock string              `json:"fromBlock,omitempty"`
+	ToBlock   string              `json:"toBlock,omitempty"`
+}
+
+type getEventsResponse struct {
+	Events []*eventWithTimestamp `json:"events"`
+}
+
+// eventWithTimestamp is the wire representation of a delivered log - kept
+// local to this file as it's the FFCAPI-facing shape, distinct from the
+// internal logEntry the events package uses for stream delivery
+type eventWithTimestamp struct {
+	BlockNumber ethbinding.HexBigInt `json:"blockNumber"`
+	Timestamp   uint64               `json:"timestamp"`
+	Data        json.RawMessage      `json:"data"`
+}
+
+// liveTap drains an events.EventChannel for a listener created without a
+// caller-registered webhook stream, buffering matched batches until the next
+// GetEventListenerStatus poll collects them. This is the concrete consumer
+// of EventSystem.Tap/SubscribeLogs that closes the loop on the FFCAPI event
+// channel delivery path - without it, a channel-mode listener's upstream
+// filter would be installed but never read
+type liveTap struct {
+	ch *events.EventChannel
+
+	mu     sync.Mutex
+	queued []*eventWithTimestamp
+}
+
+// drain runs until the tap's EventChannel is torn down (by EventChannel.Close, or
+// by the EventSystem itself closing), appending every delivered batch to the
+// queue for the next GetEventListenerStatus poll to collect
+func (lt *liveTap) drain() {
+	for {
+		select {
+		case logs, ok := <-lt.ch.Logs():
+			if !ok {
+				return
+			}
+			evs := make([]*eventWithTimestamp, len(logs))
+			for i, l := range logs {
+				data, _ := json.Marshal(l)
+				evs[i] = &eventWithTimestamp{
+					BlockNumber: l.BlockNumber,
+					Timestamp:   l.Timestamp,
+					Data:        data,
+				}
+			}
+			lt.mu.Lock()
+			lt.queued = append(lt.queued, evs...)
+			lt.mu.Unlock()
+		case <-lt.ch.Done():
+			return
+		}
+	}
+}
+
+// collect returns and clears everything queued since the last call
+func (lt *liveTap) collect() []*eventWithTimestamp {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	evs := lt.queued
+	lt.queued = nil
+	return evs
+}
+
+// attachLiveTap registers a live tap against the shared EventSystem for a
+// listener created without a caller-registered webhook stream, so its
+// deliveries can be drained via GetEventListenerStatus. Failure to attach is
+// logged rather than returned - the listener itself was already created
+// successfully via the normal stream-polling path, and live draining is a
+// best-effort addition on top of that
+func (s *ffcServer) attachLiveTap(listenerID string, filter *events.SubscriptionInfo) {
+	ec, err := s.events.EventSystem().Tap(filter.Filter)
+	if err != nil {
+		log.Warnf("Failed to attach live event channel for listener %s: %s", listenerID, err)
+		return
+	}
+	lt := &liveTap{ch: ec}
+	s.liveMu.Lock()
+	s.liveTaps[listenerID] = lt
+	s.liveMu.Unlock()
+	go lt.drain()
+}
+
+func (s *ffcServer) createEventListener(ctx context.Context, payload []byte) (res interface{}, reason ffcapi.ErrorReason, err error) {
+	var req createEventListenerRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, errors.Errorf(errors.FFCInvalidListenerRequest, err)
+	}
+	streamID := req.Stream
+	channelMode := streamID == ""
+	if streamID == "" {
+		if streamID, err = s.events.EnsureFFCAPIStream(ctx); err != nil {
+			return nil, ffcapi.ErrorReasonInvalidInputs, err
+		}
+	}
+	info := &events.SubscriptionInfo{
+		ID:        req.ListenerID,
+		Stream:    streamID,
+		Event:     req.Event,
+		FromBlock: req.FromBlock,
+	}
+	if req.Address != nil {
+		info.Filter.Addresses = []ethbinding.Address{*req.Address}
+	}
+	created, err := s.events.CreateSubscription(ctx, info)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	if channelMode {
+		s.attachLiveTap(created.ID, created)
+	}
+	return &createEventListenerResponse{ListenerID: created.ID}, "", nil
+}
+
+func (s *ffcServer) deleteEventListener(ctx context.Context, payload []byte) (res interface{}, reason ffcapi.ErrorReason, err error) {
+	var req deleteEventListenerRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, errors.Errorf(errors.FFCInvalidListenerRequest, err)
+	}
+	if err = s.events.DeleteSubscription(ctx, req.ListenerID); err != nil {
+		return nil, ffcapi.ErrorReasonNotFound, err
+	}
+	s.liveMu.Lock()
+	lt := s.liveTaps[req.ListenerID]
+	delete(s.liveTaps, req.ListenerID)
+	s.liveMu.Unlock()
+	if lt != nil {
+		lt.ch.Close()
+	}
+	return &deleteEventListenerResponse{Deleted: true}, "", nil
+}
+
+func (s *ffcServer) getEventListenerStatus(ctx context.Context, payload []byte) (res interface{}, reason ffcapi.ErrorReason, err error) {
+	var req getEventListenerStatusRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, errors.Errorf(errors.FFCInvalidListenerRequest, err)
+	}
+	if req.Reset {
+		if err = s.events.ResetSubscription(ctx, req.ListenerID); err != nil {
+			return nil, ffcapi.ErrorReasonInvalidInputs, err
+		}
+	}
+	if _, err = s.events.SubscriptionByID(req.ListenerID); err != nil {
+		return nil, ffcapi.ErrorReasonNotFound, err
+	}
+	checkpoint, err := s.events.SubscriptionCheckpoint(req.ListenerID)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonNotFound, err
+	}
+	s.liveMu.Lock()
+	lt := s.liveTaps[req.ListenerID]
+	s.liveMu.Unlock()
+	var queued []*eventWithTimestamp
+	if lt != nil {
+		queued = lt.collect()
+	}
+	return &getEventListenerStatusResponse{
+		ListenerID: req.ListenerID,
+		Checkpoint: checkpoint.String(),
+		Events:     queued,
+	}, "", nil
+}
+
+func (s *ffcServer) getEvents(ctx context.Context, payload []byte) (res interface{}, reason ffcapi.ErrorReason, err error) {
+	var req getEventsRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, errors.Errorf(errors.FFCInvalidListenerRequest, err)
+	}
+	q := &events.LogQuery{
+		FromBlock: req.FromBlock,
+		ToBlock:   req.ToBlock,
+	}
+	q.Filter.Topics = req.Topics
+	if req.Address != nil {
+		q.Filter.Addresses = []ethbinding.Address{*req.Address}
+	}
+	logs, err := s.events.QueryLogs(ctx, q)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	evs := make([]*eventWithTimestamp, len(logs))
+	for i, l := range logs {
+		data, _ := json.Marshal(l)
+		evs[i] = &eventWithTimestamp{
+			BlockNumber: l.BlockNumber,
+			Timestamp:   l.Timestamp,
+			Data:        data,
+		}
+	}
+	return &getEventsResponse{Events: evs}, "", nil
+}
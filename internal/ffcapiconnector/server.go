@@ -21,11 +21,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/Masterminds/semver"
 	"github.com/hyperledger/firefly-common/pkg/ffcapi"
 	"github.com/hyperledger/firefly-ethconnect/internal/errors"
 	"github.com/hyperledger/firefly-ethconnect/internal/eth"
+	"github.com/hyperledger/firefly-ethconnect/internal/events"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -41,30 +43,40 @@ type FFCServerConf struct {
 
 type ffcServer struct {
 	rpc          eth.RPCClient
+	events       events.SubscriptionManager
 	versionCheck *semver.Constraints
 	handlerMap   map[ffcapi.RequestType]ffcHandler
 
 	gasEstimationFactor float64
+
+	liveMu   sync.Mutex
+	liveTaps map[string]*liveTap // keyed by listener ID, for listeners draining via the FFCAPI channel rather than a webhook stream
 }
 
 type ffcHandler func(ctx context.Context, payload []byte) (res interface{}, reason ffcapi.ErrorReason, err error)
 
-func NewFFCServer(rpc eth.RPCClient, conf *FFCServerConf) FFCServer {
+func NewFFCServer(rpc eth.RPCClient, em events.SubscriptionManager, conf *FFCServerConf) FFCServer {
 	s := &ffcServer{
 		rpc:                 rpc,
+		events:              em,
 		gasEstimationFactor: conf.GasEstimationFactor,
+		liveTaps:            make(map[string]*liveTap),
 	}
 	s.handlerMap = map[ffcapi.RequestType]ffcHandler{
-		ffcapi.RequestTypeCreateBlockListener:  s.createBlockListener,
-		ffcapi.RequestTypeExecQuery:            s.execQuery,
-		ffcapi.RequestTypeGetBlockInfoByHash:   s.getBlockInfoByHash,
-		ffcapi.RequestTypeGetBlockInfoByNumber: s.getBlockInfoByNumber,
-		ffcapi.RequestTypeGetGasPrice:          s.getGasPrice,
-		ffcapi.RequestTypeGetNewBlockHashes:    s.getNewBlockHashes,
-		ffcapi.RequestTypeGetNextNonce:         s.getNextNonce,
-		ffcapi.RequestTypeGetReceipt:           s.getReceipt,
-		ffcapi.RequestTypePrepareTransaction:   s.prepareTransaction,
-		ffcapi.RequestTypeSendTransaction:      s.sendTransaction,
+		ffcapi.RequestTypeCreateBlockListener:    s.createBlockListener,
+		ffcapi.RequestTypeExecQuery:              s.execQuery,
+		ffcapi.RequestTypeGetBlockInfoByHash:     s.getBlockInfoByHash,
+		ffcapi.RequestTypeGetBlockInfoByNumber:   s.getBlockInfoByNumber,
+		ffcapi.RequestTypeGetGasPrice:            s.getGasPrice,
+		ffcapi.RequestTypeGetNewBlockHashes:      s.getNewBlockHashes,
+		ffcapi.RequestTypeGetNextNonce:           s.getNextNonce,
+		ffcapi.RequestTypeGetReceipt:             s.getReceipt,
+		ffcapi.RequestTypePrepareTransaction:     s.prepareTransaction,
+		ffcapi.RequestTypeSendTransaction:        s.sendTransaction,
+		ffcapi.RequestTypeCreateEventListener:    s.createEventListener,
+		ffcapi.RequestTypeDeleteEventListener:    s.deleteEventListener,
+		ffcapi.RequestTypeGetEventListenerStatus: s.getEventListenerStatus,
+		ffcapi.RequestTypeGetEvents:              s.getEvents,
 	}
 	s.versionCheck, _ = semver.NewConstraint(supportedAPIVersions)
 	return s
@@ -15,12 +15,43 @@
 package kldevents
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 )
 
+// ErrKeyNotFound is returned by kvStore.Get on a miss, regardless of which
+// driver is configured - callers that need to distinguish "not found" (e.g.
+// to detect a first-run/missing checkpoint) should check against this with
+// errors.Is rather than relying on a driver-specific error
+var ErrKeyNotFound = errors.New("key not found")
+
+// KVStoreType selects the backend driver used to persist subscription
+// definitions, stream checkpoints and action data
+type KVStoreType string
+
+const (
+	// KVStoreTypeLevelDB is the original embedded single-node store
+	KVStoreTypeLevelDB KVStoreType = "leveldb"
+	// KVStoreTypeEtcd shares state across replicas via an etcd v3 cluster
+	KVStoreTypeEtcd KVStoreType = "etcd"
+)
+
+// KVStoreConf is the common config for the events kvStore, with
+// driver-specific sections nested underneath
+type KVStoreConf struct {
+	Type    KVStoreType     `json:"type"`
+	LevelDB LevelDBConf     `json:"leveldb"`
+	Etcd    EtcdKVStoreConf `json:"etcd"`
+}
+
+// LevelDBConf is the config for the leveldb driver
+type LevelDBConf struct {
+	Path string `json:"path"`
+}
+
 type kvIterator interface {
 	Key() string
 	Value() []byte
@@ -28,12 +59,34 @@ type kvIterator interface {
 	Release()
 }
 
+// kvStore is the interface implemented by each pluggable storage driver for
+// the events subsystem. Keys are flat strings - drivers are free to apply
+// their own prefixing/namespacing underneath
 type kvStore interface {
 	Put(key string, val []byte) error
 	Get(key string) ([]byte, error)
 	Delete(key string) error
 	NewIterator() kvIterator
 	Close()
+	// IsLeader reports whether this replica is currently allowed to poll
+	// filters - always true for single-node drivers and for the etcd driver
+	// with election disabled, and otherwise true for the etcd driver only
+	// while it holds the configured election. Callers that drive
+	// polling should check this on each cycle and stand down as soon as it
+	// goes false, rather than only checking once at startup
+	IsLeader() bool
+}
+
+// newKVStore is the factory that selects a kvStore driver based on configuration
+func newKVStore(conf *KVStoreConf) (kvStore, error) {
+	switch conf.Type {
+	case "", KVStoreTypeLevelDB:
+		return newLDBKeyValueStore(conf.LevelDB.Path)
+	case KVStoreTypeEtcd:
+		return newEtcdKeyValueStore(&conf.Etcd)
+	default:
+		return nil, fmt.Errorf("Unknown events.storage.type '%s'", conf.Type)
+	}
 }
 
 type levelDBKeyValueStore struct {
@@ -45,7 +98,11 @@ func (k *levelDBKeyValueStore) Put(key string, val []byte) error {
 }
 
 func (k *levelDBKeyValueStore) Get(key string) ([]byte, error) {
-	return k.db.Get([]byte(key), nil)
+	val, err := k.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrKeyNotFound
+	}
+	return val, err
 }
 
 func (k *levelDBKeyValueStore) Delete(key string) error {
@@ -82,6 +139,12 @@ func (k *levelDBKeyValueStore) Close() {
 	k.db.Close()
 }
 
+// IsLeader is always true for LevelDB - it's an embedded single-node store,
+// so there's only ever one replica to begin with
+func (k *levelDBKeyValueStore) IsLeader() bool {
+	return true
+}
+
 func newLDBKeyValueStore(ldbPath string) (kv kvStore, err error) {
 	store := &levelDBKeyValueStore{}
 	if store.db, err = leveldb.OpenFile(ldbPath, nil); err != nil {
@@ -0,0 +1,375 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// etcdRangePageSize bounds how many keys are fetched per range request when
+// a caller iterates the whole keyspace via NewIterator
+const etcdRangePageSize = 256
+
+// EtcdKVStoreConf is the config for the etcd v3 kvStore driver
+type EtcdKVStoreConf struct {
+	Endpoints   []string      `json:"endpoints"`
+	Prefix      string        `json:"prefix"`
+	DialTimeout string        `json:"dialTimeout"`
+	Username    string        `json:"username"`
+	Password    string        `json:"password"`
+	TLS         EtcdTLSConf   `json:"tls"`
+	Election    EtcdElectConf `json:"election"`
+}
+
+// EtcdTLSConf configures TLS (and optional mTLS) to the etcd cluster
+type EtcdTLSConf struct {
+	Enabled    bool   `json:"enabled"`
+	CACert     string `json:"caCert"`
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+}
+
+// EtcdElectConf configures the optional leader election helper, used so
+// only one replica actively polls filters for a given subscription. Leave
+// Prefix empty to disable election (every replica polls independently)
+type EtcdElectConf struct {
+	LeaseTTLSeconds int    `json:"leaseTTLSeconds"`
+	Prefix          string `json:"prefix"`
+	ReplicaID       string `json:"replicaID"`
+}
+
+type etcdKeyValueStore struct {
+	conf   *EtcdKVStoreConf
+	client *clientv3.Client
+	prefix string
+
+	mu          sync.Mutex // guards elector, which campaignForLeadership sets asynchronously
+	elector     *LeaderElector
+	electCancel context.CancelFunc
+	leading     int32 // atomic - 1 while elector holds leadership, 0 before election, once lost, or if election is disabled
+}
+
+func newEtcdKeyValueStore(conf *EtcdKVStoreConf) (kv kvStore, err error) {
+	if len(conf.Endpoints) == 0 {
+		return nil, fmt.Errorf("No etcd endpoints configured")
+	}
+	dialTimeout := 5 * time.Second
+	if conf.DialTimeout != "" {
+		if dialTimeout, err = time.ParseDuration(conf.DialTimeout); err != nil {
+			return nil, fmt.Errorf("Invalid etcd dialTimeout '%s': %s", conf.DialTimeout, err)
+		}
+	}
+	cfg := clientv3.Config{
+		Endpoints:   conf.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    conf.Username,
+		Password:    conf.Password,
+	}
+	if conf.TLS.Enabled {
+		tlsConfig, err := buildEtcdTLSConfig(&conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsConfig
+	}
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to etcd at %v: %s", conf.Endpoints, err)
+	}
+	store := &etcdKeyValueStore{
+		conf:   conf,
+		client: client,
+		prefix: conf.Prefix,
+	}
+	if conf.Election.Prefix != "" {
+		// Campaign on its own goroutine rather than blocking here - a standby
+		// replica must return from the constructor and sit ready to take
+		// over, not freeze until it eventually wins (which may never happen
+		// for the lifetime of the process, if another replica holds the
+		// lease throughout). electCancel lets Close() abandon an in-flight
+		// campaign that never won
+		ctx, cancel := context.WithCancel(context.Background())
+		store.electCancel = cancel
+		go store.campaignForLeadership(ctx)
+	}
+	kv = store
+	return
+}
+
+// campaignForLeadership campaigns for the "default" election until it wins
+// or ctx is cancelled, flipping leading to 1 once it does, then handing off
+// to watchLeadership to notice if that lease is later lost
+func (k *etcdKeyValueStore) campaignForLeadership(ctx context.Context) {
+	elector, err := newLeaderElector(ctx, k.client, &k.conf.Election, "default", k.replicaID())
+	if err != nil {
+		// ctx was cancelled (Close was called before we won) or the campaign
+		// itself failed - either way there is no elector to watch
+		return
+	}
+	k.mu.Lock()
+	k.elector = elector
+	k.mu.Unlock()
+	atomic.StoreInt32(&k.leading, 1)
+	k.watchLeadership()
+}
+
+// watchLeadership clears the leading flag as soon as this replica's lease is
+// lost - e.g. a GC pause or network partition that outlasts the lease TTL -
+// so IsLeader reflects reality promptly rather than reporting leadership
+// right up until the process is restarted
+func (k *etcdKeyValueStore) watchLeadership() {
+	<-k.elector.Done()
+	atomic.StoreInt32(&k.leading, 0)
+}
+
+// IsLeader reports whether this replica currently holds leadership of the
+// configured election prefix. Always true when election is disabled, since
+// every replica is then free to poll independently
+func (k *etcdKeyValueStore) IsLeader() bool {
+	if k.conf.Election.Prefix == "" {
+		return true
+	}
+	return atomic.LoadInt32(&k.leading) == 1
+}
+
+// AcquireLeadership campaigns for leadership of the named resource (for
+// example a subscription ID, so each subscription can be polled by a
+// different replica) and blocks until this replica wins or ctx is
+// cancelled. Callers should stop polling that resource - handing off to a
+// standby replica - as soon as the returned elector's Done() channel closes.
+// When election is disabled it returns a nil elector and nil error at once
+func (k *etcdKeyValueStore) AcquireLeadership(ctx context.Context, resource string) (*LeaderElector, error) {
+	if k.conf.Election.Prefix == "" {
+		return nil, nil
+	}
+	return newLeaderElector(ctx, k.client, &k.conf.Election, resource, k.replicaID())
+}
+
+func (k *etcdKeyValueStore) replicaID() string {
+	if k.conf.Election.ReplicaID != "" {
+		return k.conf.Election.ReplicaID
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return fmt.Sprintf("replica-%d", time.Now().UnixNano())
+}
+
+func buildEtcdTLSConfig(conf *EtcdTLSConf) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if conf.CACert != "" {
+		caPEM, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read etcd CA cert %s: %s", conf.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("Failed to parse etcd CA cert %s", conf.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.ClientCert != "" || conf.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load etcd client keypair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (k *etcdKeyValueStore) key(key string) string {
+	return k.prefix + key
+}
+
+func (k *etcdKeyValueStore) Put(key string, val []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := k.client.Put(ctx, k.key(key), string(val))
+	return err
+}
+
+func (k *etcdKeyValueStore) Get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := k.client.Get(ctx, k.key(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (k *etcdKeyValueStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := k.client.Delete(ctx, k.key(key))
+	return err
+}
+
+// NewIterator returns an iterator that pages through the whole prefix range
+// using etcd's range queries, fetching etcdRangePageSize keys at a time
+func (k *etcdKeyValueStore) NewIterator() kvIterator {
+	return &etcdKeyIterator{
+		store:    k,
+		fromKey:  k.prefix,
+		pageSize: etcdRangePageSize,
+	}
+}
+
+func (k *etcdKeyValueStore) Close() {
+	if k.electCancel != nil {
+		// Abandon an in-flight campaign that never won - otherwise
+		// campaignForLeadership's goroutine, and the client it holds open,
+		// would outlive the store
+		k.electCancel()
+	}
+	k.mu.Lock()
+	elector := k.elector
+	k.mu.Unlock()
+	if elector != nil {
+		elector.Close()
+	}
+	_ = k.client.Close()
+}
+
+type etcdKeyIterator struct {
+	store    *etcdKeyValueStore
+	fromKey  string
+	pageSize int64
+	page     []*clientv3.KeyValue
+	pos      int
+	done     bool
+}
+
+// fetchPage retrieves the next page of keys from fromKey (inclusive) up to
+// the end of the prefix range, ordered by key, and advances fromKey past the
+// last key returned so the next fetch picks up the cursor where this left off
+func (it *etcdKeyIterator) fetchPage() bool {
+	if it.done {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := it.store.client.Get(ctx, it.fromKey,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(it.store.prefix)),
+		clientv3.WithLimit(it.pageSize),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil || len(resp.Kvs) == 0 {
+		it.done = true
+		return false
+	}
+	it.page = resp.Kvs
+	it.pos = 0
+	last := resp.Kvs[len(resp.Kvs)-1]
+	// Advance the cursor to just after the last key we received. etcd range
+	// keys are byte strings, so appending a NUL byte is the smallest possible
+	// increment that still sorts after the last key
+	it.fromKey = string(last.Key) + "\x00"
+	if !resp.More {
+		// We've consumed the final page - still yield it, but stop re-fetching
+		it.done = true
+	}
+	return true
+}
+
+func (it *etcdKeyIterator) Key() string {
+	return string(it.page[it.pos].Key)[len(it.store.prefix):]
+}
+
+func (it *etcdKeyIterator) Value() []byte {
+	return it.page[it.pos].Value
+}
+
+func (it *etcdKeyIterator) Next() bool {
+	if it.page == nil {
+		return it.fetchPage() && len(it.page) > 0
+	}
+	it.pos++
+	if it.pos < len(it.page) {
+		return true
+	}
+	return it.fetchPage() && len(it.page) > 0
+}
+
+func (it *etcdKeyIterator) Release() {
+	it.done = true
+	it.page = nil
+}
+
+// LeaderElector wraps etcd's lease-based concurrency primitives so only one
+// ethconnect replica actively polls filters for a given subscription, while
+// the rest stand by ready to take over campaigning as soon as the leader's
+// lease expires (on crash, network partition, or graceful shutdown)
+type LeaderElector struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+	resigned chan struct{}
+}
+
+// newLeaderElector campaigns for leadership of the given key under the
+// election prefix, blocking until either this replica becomes leader or ctx
+// is cancelled
+func newLeaderElector(ctx context.Context, client *clientv3.Client, conf *EtcdElectConf, key string, replicaID string) (*LeaderElector, error) {
+	ttl := conf.LeaseTTLSeconds
+	if ttl <= 0 {
+		ttl = 15
+	}
+	session, err := concurrency.NewSession(client, concurrency.WithTTL(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create etcd leader election session: %s", err)
+	}
+	election := concurrency.NewElection(session, conf.Prefix+key)
+	if err := election.Campaign(ctx, replicaID); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("Failed to campaign for leadership of %s: %s", key, err)
+	}
+	return &LeaderElector{
+		session:  session,
+		election: election,
+		resigned: make(chan struct{}),
+	}, nil
+}
+
+// Done is closed by etcd if the underlying lease is lost (e.g. the client
+// lost connectivity for longer than the TTL), signalling this replica must
+// stop acting as leader
+func (l *LeaderElector) Done() <-chan struct{} {
+	return l.session.Done()
+}
+
+// Resign gives up leadership so another standby replica can take over
+func (l *LeaderElector) Resign(ctx context.Context) error {
+	return l.election.Resign(ctx)
+}
+
+// Close releases the underlying etcd lease/session. Safe to call after Resign
+func (l *LeaderElector) Close() {
+	_ = l.session.Close()
+}
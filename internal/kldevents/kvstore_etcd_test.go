@@ -0,0 +1,151 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEmbeddedEtcd boots a single-node etcd server on an ephemeral port for
+// the lifetime of the test, returning its client endpoint
+func startEmbeddedEtcd(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "etcd-kvstore-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = cfg.ListenClientUrls
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start embedded etcd: %s", err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd took too long to start")
+	}
+	return e.Clients[0].Addr().String()
+}
+
+func TestEtcdKeyValueStoreCRUDAndIterator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping embedded etcd test in short mode")
+	}
+	endpoint := startEmbeddedEtcd(t)
+
+	conf := &EtcdKVStoreConf{
+		Endpoints: []string{endpoint},
+		Prefix:    fmt.Sprintf("test-%d/", time.Now().UnixNano()),
+	}
+	kv, err := newEtcdKeyValueStore(conf)
+	if err != nil {
+		t.Fatalf("failed to create etcd kvStore: %s", err)
+	}
+	defer kv.Close()
+
+	if !kv.IsLeader() {
+		t.Error("expected IsLeader to be true when election is disabled")
+	}
+
+	if _, err := kv.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+
+	if err := kv.Put("a", []byte("1")); err != nil {
+		t.Fatalf("failed to put a: %s", err)
+	}
+	if err := kv.Put("b", []byte("2")); err != nil {
+		t.Fatalf("failed to put b: %s", err)
+	}
+
+	val, err := kv.Get("a")
+	if err != nil || string(val) != "1" {
+		t.Errorf("expected to get back a=1, got %q err=%v", val, err)
+	}
+
+	seen := map[string]string{}
+	it := kv.NewIterator()
+	for it.Next() {
+		seen[it.Key()] = string(it.Value())
+	}
+	it.Release()
+	if seen["a"] != "1" || seen["b"] != "2" {
+		t.Errorf("expected iterator to yield both a and b, got %+v", seen)
+	}
+
+	if err := kv.Delete("a"); err != nil {
+		t.Fatalf("failed to delete a: %s", err)
+	}
+	if _, err := kv.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound after delete, got %v", err)
+	}
+}
+
+// TestEtcdKeyValueStoreCampaignsAsynchronously checks that, with election
+// enabled, newEtcdKeyValueStore returns within a second, and that the sole
+// replica then goes on to win the election in the background
+func TestEtcdKeyValueStoreCampaignsAsynchronously(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping embedded etcd test in short mode")
+	}
+	endpoint := startEmbeddedEtcd(t)
+
+	conf := &EtcdKVStoreConf{
+		Endpoints: []string{endpoint},
+		Prefix:    fmt.Sprintf("test-%d/", time.Now().UnixNano()),
+		Election: EtcdElectConf{
+			Prefix:          fmt.Sprintf("election-%d/", time.Now().UnixNano()),
+			LeaseTTLSeconds: 2,
+		},
+	}
+
+	start := time.Now()
+	kv, err := newEtcdKeyValueStore(conf)
+	if err != nil {
+		t.Fatalf("failed to create etcd kvStore: %s", err)
+	}
+	defer kv.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected newEtcdKeyValueStore to return immediately rather than block on the campaign, took %s", elapsed)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !kv.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !kv.IsLeader() {
+		t.Fatal("expected the sole replica to win the election eventually")
+	}
+}